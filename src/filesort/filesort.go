@@ -2,14 +2,278 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// maxMergeFanIn caps how many sorted files merge() will combine in a single
+// pass.  Now that sourceSet is a min-heap, popMin is O(log k) instead of
+// O(k), so this can be much higher than the old hard-coded limit of 100
+// without making each merge pass slow.
+const maxMergeFanIn = 1000
+
+// Config controls how lines are ordered and deduplicated, and is threaded
+// through split, merge and sourceSet so every stage of the sort agrees on
+// what "less" and "equal" mean.
+type Config struct {
+	Less   func(a, b string) bool
+	Unique bool
+
+	// Workers caps how many chunks split sorts and flushes to disk at once.
+	// A value below 1 means runtime.GOMAXPROCS(0).
+	Workers int
+
+	// ByteLimit caps the approximate in-memory size of an initial chunk, by
+	// summing line lengths as they are read.  A chunk ends as soon as
+	// either ByteLimit or the line-count limit passed to split is reached,
+	// whichever comes first.  Zero disables the byte-based cutoff.
+	ByteLimit int64
+
+	// FS is the filesystem backend used for spill (chunk and merge) temp
+	// files.  A nil FS means OSFS{}.
+	FS FS
+
+	// TempDir is where spill files are created, passed through to FS's
+	// TempFile.  An empty string means the backend's own default (for
+	// OSFS, the directory returned by os.TempDir).
+	TempDir string
+}
+
+// DefaultConfig sorts lines in plain byte-lexicographic order and keeps
+// duplicates, matching the historical behavior of this package.
+func DefaultConfig() Config {
+	return Config{Less: func(a, b string) bool { return a < b }}
+}
+
+// fs returns the Config's filesystem backend, defaulting to OSFS{}.
+func (cfg Config) fs() FS {
+	if cfg.FS == nil {
+		return OSFS{}
+	}
+	return cfg.FS
+}
+
+// File is the subset of *os.File that split and merge need from a spill
+// file: it can be read from or written to (never both at once) and closed.
+type File interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// FS abstracts the filesystem operations split and merge perform on spill
+// files, so callers can redirect them to a scratch disk via TempDir, or
+// swap in an in-memory backend such as MemFS for tests.
+type FS interface {
+	TempFile(dir, prefix string) (File, error)
+	Open(name string) (File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// OSFS is the default FS, backed directly by the real filesystem.
+type OSFS struct{}
+
+func (OSFS) TempFile(dir, prefix string) (File, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+
+func (OSFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// A memFile is a MemFS-backed File: a bytes.Buffer while open for writing,
+// or a snapshot bytes.Reader while open for reading, never both.
+type memFile struct {
+	name   string
+	fs     *MemFS
+	wbuf   *bytes.Buffer
+	reader *bytes.Reader
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.wbuf == nil {
+		return 0, fmt.Errorf("memFile %v: not open for writing", f.name)
+	}
+	return f.wbuf.Write(p)
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, fmt.Errorf("memFile %v: not open for reading", f.name)
+	}
+	return f.reader.Read(p)
+}
+
+func (f *memFile) Close() error {
+	if f.wbuf != nil {
+		f.fs.store(f.name, f.wbuf.Bytes())
+	}
+	return nil
+}
+
+// MemFS is an in-memory FS, for unit-testing split/merge without touching
+// the real filesystem.
+type MemFS struct {
+	mu      sync.Mutex
+	files   map[string][]byte
+	counter int
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string][]byte)}
+}
+
+func (fs *MemFS) store(name string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[name] = append([]byte(nil), data...)
+}
+
+func (fs *MemFS) TempFile(dir, prefix string) (File, error) {
+	fs.mu.Lock()
+	fs.counter++
+	name := fmt.Sprintf("%v/%v%d", dir, prefix, fs.counter)
+	fs.files[name] = nil
+	fs.mu.Unlock()
+
+	return &memFile{name: name, fs: fs, wbuf: &bytes.Buffer{}}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	fs.mu.Lock()
+	data, ok := fs.files[name]
+	fs.mu.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return &memFile{name: name, fs: fs, reader: bytes.NewReader(data)}, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[oldpath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	fs.files[newpath] = data
+	delete(fs.files, oldpath)
+	return nil
+}
+
+// Extracts the sort key out of a line: field number key (1-based) split on
+// delim, or the whole line when key is 0.  An empty delim splits on runs of
+// whitespace, like awk/sort with no -t.
+func fieldKey(line string, key int, delim string) string {
+	if key <= 0 {
+		return line
+	}
+
+	trimmed := strings.TrimRight(line, "\n")
+	var fields []string
+	if delim == "" {
+		fields = strings.Fields(trimmed)
+	} else {
+		fields = strings.Split(trimmed, delim)
+	}
+	if key > len(fields) {
+		return ""
+	}
+	return fields[key-1]
+}
+
+// Compares two keys numerically, falling back to a string comparison when
+// either side does not parse as a number.
+func numericLess(a, b string) bool {
+	af, aerr := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	bf, berr := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if aerr != nil || berr != nil {
+		return a < b
+	}
+	return af < bf
+}
+
+// Parses a human-readable byte size such as "256M" or "10G" (suffixes K, M,
+// G are powers of 1024; no suffix means plain bytes).  An empty string
+// parses as 0.
+func parseByteSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult = 1 << 10
+		s = s[:len(s)-1]
+	case 'm', 'M':
+		mult = 1 << 20
+		s = s[:len(s)-1]
+	case 'g', 'G':
+		mult = 1 << 30
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q: %v", s, err)
+	}
+	return n * mult, nil
+}
+
+// BuildLess returns a Less function for Config, honoring reverse order,
+// numeric comparison, and a key column (1-based; 0 means the whole line)
+// split on delim.
+func BuildLess(reverse, numeric bool, key int, delim string) func(a, b string) bool {
+	less := func(a, b string) bool {
+		ka, kb := fieldKey(a, key, delim), fieldKey(b, key, delim)
+		if numeric {
+			return numericLess(ka, kb)
+		}
+		return ka < kb
+	}
+	if !reverse {
+		return less
+	}
+	return func(a, b string) bool { return less(b, a) }
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -42,27 +306,37 @@ func strSliceSplit(s []string, limit int) [][]string {
 }
 
 // Deletes a filename without reporting back errors, if any.
-func deleteFile(filename string) {
+func deleteFile(fs FS, filename string) {
 	fmt.Fprintf(os.Stderr, "Erasing temp file %v...\n", filename)
-	if err := os.Remove(filename); err != nil {
+	if err := fs.Remove(filename); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
 }
 
 // Deletes multiple filenames without reporting back errors, if any.
-func deleteFiles(filenames []string) {
+func deleteFiles(fs FS, filenames []string) {
 	for _, filename := range filenames {
-		deleteFile(filename)
+		deleteFile(fs, filename)
 	}
 }
 
-// A source represents sorted text file as a stack, where only the top line is
-// available.
+// A lineSource represents a sorted stack of lines, where only the top line
+// is available, backed by either a file or an in-memory channel.
+type lineSource interface {
+	current() string
+	pop() error
+}
+
+// A source represents a sorted text file as a lineSource.
 type source struct {
 	top string
 	r   *bufio.Reader
 }
 
+func (s *source) current() string {
+	return s.top
+}
+
 // Updates the top line with the next one from the file.
 func (s *source) pop() error {
 	var err error
@@ -70,56 +344,162 @@ func (s *source) pop() error {
 	return err
 }
 
-// A sourceSet combines multiple sources into one sorted stack of lines.
-type sourceSet map[*source]bool
+// Wraps an io.Reader as a lineSource, positioned at its first line.  Returns
+// io.EOF if the reader holds no lines.
+func newFileSource(r io.Reader) (*source, error) {
+	s := &source{"", bufio.NewReader(r)}
+	err := s.pop()
+	return s, err
+}
 
-func newSourceSet(rs []io.Reader) (sourceSet, error) {
-	ss := make(sourceSet)
+// A chanSource represents an in-memory channel of already-sorted lines as a
+// lineSource, letting merge pull from channel-backed input alongside
+// file-backed input.
+type chanSource struct {
+	top string
+	ch  <-chan string
+}
+
+func (c *chanSource) current() string {
+	return c.top
+}
+
+// Updates the top line with the next one from the channel.  Returns io.EOF
+// once the channel is closed and drained.
+func (c *chanSource) pop() error {
+	line, ok := <-c.ch
+	if !ok {
+		return io.EOF
+	}
+	c.top = line
+	return nil
+}
+
+// Wraps a channel as a lineSource, positioned at its first line.  Returns
+// io.EOF if the channel is already closed and empty.
+func newChanSource(ch <-chan string) (*chanSource, error) {
+	c := &chanSource{ch: ch}
+	err := c.pop()
+	return c, err
+}
+
+// A sourceSet combines multiple lineSources into one sorted stack of lines,
+// backed by a binary min-heap so the minimum can always be found and removed
+// in O(log k) time for k sources.
+type sourceSet struct {
+	nodes  []lineSource
+	less   func(a, b string) bool
+	unique bool
+
+	hasLast bool
+	last    string
+}
+
+func left(i int) int  { return 2*i + 1 }
+func right(i int) int { return 2*i + 2 }
+
+// newSourceSetFrom builds a sourceSet out of already-positioned lineSources.
+func newSourceSetFrom(nodes []lineSource, cfg Config) *sourceSet {
+	ss := &sourceSet{nodes: nodes, less: cfg.Less, unique: cfg.Unique}
+
+	for i := (len(ss.nodes) - 1) / 2; i >= 0; i-- {
+		ss.siftDown(i)
+	}
+
+	return ss
+}
+
+func newSourceSet(rs []io.Reader, cfg Config) (*sourceSet, error) {
+	nodes := make([]lineSource, 0, len(rs))
 
 	for _, r := range rs {
-		s := &source{"", bufio.NewReader(r)}
-		err := s.pop()
+		s, err := newFileSource(r)
 		if err == io.EOF {
 			continue
 		}
 		if err != nil {
 			return nil, err
 		}
-		ss[s] = true
+		nodes = append(nodes, s)
 	}
 
-	return ss, nil
+	return newSourceSetFrom(nodes, cfg), nil
 }
 
-// Returns the current minimum line in the whole sourceSet, removing it from the
-// set.
-func (ss sourceSet) popMin() (string, error) {
-	var min *source
-	first := true
+func (ss *sourceSet) len() int {
+	return len(ss.nodes)
+}
 
-	for s, _ := range ss {
-		if first {
-			min = s
-			first = false
-			continue
+// equal reports whether a and b compare equal under ss.less, i.e. neither
+// is less than the other.
+func (ss *sourceSet) equal(a, b string) bool {
+	return !ss.less(a, b) && !ss.less(b, a)
+}
+
+// Restores the heap property below index i, assuming both of its subtrees
+// are already valid heaps.
+func (ss *sourceSet) siftDown(i int) {
+	n := len(ss.nodes)
+	for {
+		smallest := i
+		if l := left(i); l < n && ss.less(ss.nodes[l].current(), ss.nodes[smallest].current()) {
+			smallest = l
 		}
-		if s.top < min.top {
-			min = s
+		if r := right(i); r < n && ss.less(ss.nodes[r].current(), ss.nodes[smallest].current()) {
+			smallest = r
 		}
+		if smallest == i {
+			return
+		}
+		ss.nodes[i], ss.nodes[smallest] = ss.nodes[smallest], ss.nodes[i]
+		i = smallest
 	}
+}
 
-	result := min.top
+// Removes and returns the current minimum line in the whole sourceSet.  The
+// root of the heap is replaced by the last element and sifted back down.
+func (ss *sourceSet) popRawMin() (string, error) {
+	min := ss.nodes[0]
+	result := min.current()
 
 	// Advance the consumed source
 	err := min.pop()
 	if err == io.EOF {
-		delete(ss, min)
 		err = nil
+		last := len(ss.nodes) - 1
+		ss.nodes[0] = ss.nodes[last]
+		ss.nodes = ss.nodes[:last]
+	}
+
+	if len(ss.nodes) > 0 {
+		ss.siftDown(0)
 	}
 
 	return result, err
 }
 
+// Returns the current minimum line in the whole sourceSet, removing it from
+// the set.  When unique is set, lines whose sort key equals the previously
+// returned one are skipped; ok is false once the set is drained.
+func (ss *sourceSet) popMin() (line string, ok bool, err error) {
+	for ss.len() > 0 {
+		line, err = ss.popRawMin()
+		if err != nil {
+			return "", false, err
+		}
+
+		if ss.unique && ss.hasLast && ss.equal(line, ss.last) {
+			continue
+		}
+
+		ss.hasLast = true
+		ss.last = line
+		return line, true, nil
+	}
+
+	return "", false, nil
+}
+
 // A stringWriter is a writer that accepts strings. This is a common interface
 // for bufio.Writer and bytes.Buffer, allowing interchangable use of one instead
 // of the other.
@@ -128,37 +508,42 @@ type stringWriter interface {
 }
 
 // Merges a set of sorted inputs into one sorted output.
-func mergeSimple(rs []io.Reader, w stringWriter) error {
+func mergeSimple(rs []io.Reader, w stringWriter, cfg Config) error {
 	// Initialize source set
-	sources, err := newSourceSet(rs)
+	sources, err := newSourceSet(rs, cfg)
 	if err != nil {
 		return err
 	}
 
 	// Do merge
-	for (len(sources) > 0) && (err == nil) {
+	for {
 		var min string
-		min, err = sources.popMin()
+		var ok bool
+		min, ok, err = sources.popMin()
 		if err != nil {
 			return err
 		}
-		_, err = w.WriteString(min)
+		if !ok {
+			return nil
+		}
+		if _, err = w.WriteString(min); err != nil {
+			return err
+		}
 	}
-
-	return err
 }
 
 // Merges a set of sorted input files into one sorted output file.  After the
 // merge input files are deleted.
-func mergeSimpleFiles(names []string) (string, error) {
+func mergeSimpleFiles(names []string, cfg Config) (string, error) {
+	fs := cfg.fs()
 
 	// Schedule deletion of all input files
 	defer func() {
-		deleteFiles(names)
+		deleteFiles(fs, names)
 	}()
 
 	// Create output file
-	outf, err := ioutil.TempFile("", "filesort_merge_")
+	outf, err := fs.TempFile(cfg.TempDir, "filesort_merge_")
 	if err != nil {
 		return "", err
 	}
@@ -171,8 +556,8 @@ func mergeSimpleFiles(names []string) (string, error) {
 	// Prepare all input files
 	var files = make([]io.Reader, 0, len(names))
 	for _, name := range names {
-		var f *os.File
-		f, err = os.Open(name)
+		var f File
+		f, err = fs.Open(name)
 		if err != nil {
 			break
 		}
@@ -184,7 +569,7 @@ func mergeSimpleFiles(names []string) (string, error) {
 	}
 
 	if err == nil {
-		err = mergeSimple(files, out)
+		err = mergeSimple(files, out, cfg)
 	}
 	if err == nil {
 		err = out.Flush()
@@ -193,7 +578,7 @@ func mergeSimpleFiles(names []string) (string, error) {
 	// If the merge fails, delete the output file
 	if err != nil {
 		defer func() {
-			deleteFile(outf.Name())
+			deleteFile(fs, outf.Name())
 		}()
 	}
 
@@ -204,7 +589,7 @@ func mergeSimpleFiles(names []string) (string, error) {
 // than limit number opened input files at a time.  After the merge the input
 // files are deleted, unless it is only one file, in which case it is returned
 // as result.
-func merge(names []string, limit int) (string, error) {
+func merge(names []string, limit int, cfg Config) (string, error) {
 	// Handle basic cases
 	switch len(names) {
 	case 0:
@@ -215,14 +600,14 @@ func merge(names []string, limit int) (string, error) {
 
 	// Simple merge when the number of files is within the limit
 	if len(names) <= limit {
-		return mergeSimpleFiles(names)
+		return mergeSimpleFiles(names, cfg)
 	}
 
 	// Recursively reduce names to the limit
 	name_groups := strSliceSplit(names, limit)
 	reduced_names := make([]string, 0, len(name_groups))
 	for _, group := range name_groups {
-		name, err := merge(group, limit)
+		name, err := merge(group, limit, cfg)
 		if name != "" {
 			reduced_names = append(reduced_names, name)
 		}
@@ -230,16 +615,19 @@ func merge(names []string, limit int) (string, error) {
 			return "", err
 		}
 	}
-	return merge(reduced_names, limit)
+	return merge(reduced_names, limit, cfg)
 }
 
-// Reads limit number of lines from a bufio.Reader.  If the last line does not
+// Reads up to limit lines from a bufio.Reader, stopping early once the
+// summed length of the lines read so far reaches byteLimit (unless byteLimit
+// is 0, which disables the byte-based cutoff).  If the last line does not
 // end with a newline, it is automatically appended.
-func readLines(r *bufio.Reader, limit int) ([]string, error) {
+func readLines(r *bufio.Reader, limit int, byteLimit int64) ([]string, error) {
 	lines := make([]string, 0, limit)
 	var err error
+	var size int64
 
-	for (len(lines) < limit) && (err == nil) {
+	for (len(lines) < limit) && ((byteLimit <= 0) || (size < byteLimit)) && (err == nil) {
 		var line string
 		line, err = r.ReadString('\n')
 		if err != nil {
@@ -254,14 +642,15 @@ func readLines(r *bufio.Reader, limit int) ([]string, error) {
 			}
 		}
 		lines = append(lines, line)
+		size += int64(len(line))
 	}
 
 	return lines, err
 }
 
 // Writes an initial sorted chunk as temp file and returns its name.
-func writeChunk(lines []string) (string, error) {
-	f, err := ioutil.TempFile("", "filesort_chunk_")
+func writeChunk(lines []string, cfg Config) (string, error) {
+	f, err := cfg.fs().TempFile(cfg.TempDir, "filesort_chunk_")
 	if err != nil {
 		return "", err
 	}
@@ -283,79 +672,156 @@ func writeChunk(lines []string) (string, error) {
 	return name, buf.Flush()
 }
 
-// Splits an input io.Reader into a number of output chunk files, with no more
-// than limit number of lines in each file.  Lines inside each chunk are sorted
-// in memory.  Returns the created filenames.
-func split(r io.Reader, limit int) ([]string, error) {
-	in := bufio.NewReader(r)
-	var chunk_names []string
-	var err error
+// Drops lines from an in-memory-sorted slice whose sort key equals that of
+// the previous line, keeping only the first of each run.
+func uniqSorted(lines []string, cfg Config) []string {
+	if len(lines) < 2 {
+		return lines
+	}
 
-	for err == nil {
-		var lines []string
-		lines, err = readLines(in, limit)
-		if (err != nil) && (err != io.EOF) {
-			break
+	result := lines[:1]
+	for _, line := range lines[1:] {
+		prev := result[len(result)-1]
+		if cfg.Less(prev, line) || cfg.Less(line, prev) {
+			result = append(result, line)
 		}
+	}
+	return result
+}
 
-		// Skip trailing empty chunks
-		if (len(lines) == 0) && (len(chunk_names) > 0) {
-			break
-		}
+// A chunkResult is what a split worker reports back for one chunk: the name
+// of the chunk file it wrote, or an error.
+type chunkResult struct {
+	name string
+	err  error
+}
+
+// sortChunk sorts a chunk in memory according to cfg and flushes it to a
+// temp file, returning its name.
+func sortChunk(lines []string, cfg Config) (string, error) {
+	sort.Slice(lines, func(i, j int) bool { return cfg.Less(lines[i], lines[j]) })
+	if cfg.Unique {
+		lines = uniqSorted(lines, cfg)
+	}
+	return writeChunk(lines, cfg)
+}
+
+// Splits an input io.Reader into a number of output chunk files, with no more
+// than limit number of lines in each file.  Lines inside each chunk are
+// sorted in memory according to cfg.  Returns the created filenames.
+//
+// Reading proceeds on the caller's goroutine while up to cfg.Workers worker
+// goroutines sort and flush previously read chunks to disk in parallel, so
+// CPU-bound sorting overlaps with I/O instead of alternating with it.
+func split(r io.Reader, limit int, cfg Config) ([]string, error) {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobs := make(chan []string, workers)
+	results := make(chan chunkResult, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for lines := range jobs {
+				name, err := sortChunk(lines, cfg)
+				results <- chunkResult{name, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-		sort.Strings(lines)
+	var readErr error
+	go func() {
+		defer close(jobs)
+
+		in := bufio.NewReader(r)
+		sent := false
+		for {
+			lines, err := readLines(in, limit, cfg.ByteLimit)
+			if len(lines) > 0 {
+				jobs <- lines
+				sent = true
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				} else if !sent {
+					// Always emit at least one chunk, even an empty one, so
+					// that merge never sees zero names.
+					jobs <- lines
+				}
+				return
+			}
+		}
+	}()
 
-		var name string
-		if name, err = writeChunk(lines); name != "" {
-			chunk_names = append(chunk_names, name)
+	var chunk_names []string
+	var err error
+	for res := range results {
+		if res.err != nil {
+			if err == nil {
+				err = res.err
+			}
+			continue
+		}
+		if res.name != "" {
+			chunk_names = append(chunk_names, res.name)
 		}
 	}
 
-	if err == io.EOF {
-		err = nil
+	if err == nil {
+		err = readErr
 	}
 
 	return chunk_names, err
 }
 
 // Reads and all lines from an input io.Reader and sorts them into an output
-// file.  The sorting algorithm uses no more than limit number of lines at a
-// time.  Returns the name of the sorted output file.
-func sortLines(r io.Reader, limit int) (string, error) {
-	names, err := split(r, limit)
+// file, according to cfg.  The sorting algorithm uses no more than limit
+// number of lines at a time.  Returns the name of the sorted output file.
+func sortLines(r io.Reader, limit int, cfg Config) (string, error) {
+	names, err := split(r, limit, cfg)
 	if err != nil {
-		deleteFiles(names)
+		deleteFiles(cfg.fs(), names)
 		return "", err
 	}
 
-	return merge(names, min(100, max(10, limit)))
+	return merge(names, min(maxMergeFanIn, max(10, limit)), cfg)
 }
 
 // Reads and all lines from an input io.Reader and sorts them into a specified
-// output file.  The sorting algorithm uses no more than limit number of lines
-// at a time.
-func sortLinesFile(r io.Reader, limit int, outfile string) error {
-	name, err := sortLines(r, limit)
+// output file, according to cfg.  The sorting algorithm uses no more than
+// limit number of lines at a time.
+func sortLinesFile(r io.Reader, limit int, outfile string, cfg Config) error {
+	name, err := sortLines(r, limit, cfg)
 	if err != nil {
 		return err
 	}
 
-	return os.Rename(name, outfile)
+	return cfg.fs().Rename(name, outfile)
 }
 
-// Reads and all lines from an input io.Reader and writes them in sorted order
-// into a specified output io.Writer.  The sorting algorithm uses no more than
-// limit number of lines at a time.
-func sortLinesWrite(r io.Reader, limit int, w io.Writer) error {
-	name, err := sortLines(r, limit)
+// Reads and all lines from an input io.Reader and writes them in sorted order,
+// according to cfg, into a specified output io.Writer.  The sorting algorithm
+// uses no more than limit number of lines at a time.
+func sortLinesWrite(r io.Reader, limit int, w io.Writer, cfg Config) error {
+	name, err := sortLines(r, limit, cfg)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		deleteFile(name)
+		deleteFile(cfg.fs(), name)
 	}()
 
-	f, err := os.Open(name)
+	f, err := cfg.fs().Open(name)
 	if err != nil {
 		return err
 	}
@@ -369,12 +835,190 @@ func sortLinesWrite(r io.Reader, limit int, w io.Writer) error {
 	return err
 }
 
+// Drains up to limit lines from in, for use as an in-memory chunk.  ok is
+// false once in is closed and drained.
+func drainChannel(in <-chan string, limit int) (lines []string, ok bool) {
+	lines = make([]string, 0, limit)
+	for len(lines) < limit {
+		line, open := <-in
+		if !open {
+			return lines, false
+		}
+		lines = append(lines, line)
+	}
+	return lines, true
+}
+
+// SortChannel sorts the lines received on in according to cfg and streams
+// them out in order on the returned channel, which is closed once in is
+// closed and fully drained, or once ctx is done.  As elsewhere in this
+// package, a "line" is expected to end with '\n' (sortLinesWrite's output is
+// valid input here); chunks that spill to disk rely on that to read back
+// correctly.  It is the channel-based counterpart of sortLines: up to limit
+// lines are sorted in memory at a time; if they all fit in one such chunk
+// they are streamed out directly, otherwise each chunk spills to a temp
+// file and the chunks are merged the same way sortLines merges split's
+// output.  Errors are reported to stderr, since the channel API has no way
+// to return them to the caller.  If the consumer stops reading out before
+// it is drained, cancel ctx so the producing goroutine can stop and clean
+// up its temp files instead of blocking on out forever.
+func SortChannel(ctx context.Context, in <-chan string, limit int, cfg Config) <-chan string {
+	out := make(chan string)
+
+	send := func(line string) bool {
+		select {
+		case out <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(out)
+
+		var names []string
+
+		for {
+			lines, more := drainChannel(in, limit)
+			if len(lines) == 0 {
+				break
+			}
+
+			sort.Slice(lines, func(i, j int) bool { return cfg.Less(lines[i], lines[j]) })
+			if cfg.Unique {
+				lines = uniqSorted(lines, cfg)
+			}
+
+			if !more && len(names) == 0 {
+				// Everything fit in a single chunk: stream it out directly,
+				// with no need to spill to disk.
+				for _, line := range lines {
+					if !send(line) {
+						return
+					}
+				}
+				return
+			}
+
+			name, err := writeChunk(lines, cfg)
+			if name != "" {
+				names = append(names, name)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				deleteFiles(cfg.fs(), names)
+				return
+			}
+
+			if ctx.Err() != nil {
+				deleteFiles(cfg.fs(), names)
+				return
+			}
+
+			if !more {
+				break
+			}
+		}
+
+		if len(names) == 0 {
+			return
+		}
+
+		name, err := merge(names, min(maxMergeFanIn, max(10, limit)), cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return
+		}
+		defer deleteFile(cfg.fs(), name)
+
+		f, err := cfg.fs().Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return
+		}
+		defer f.Close()
+
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadString('\n')
+			if len(line) > 0 {
+				if !send(line) {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	return out
+}
+
+// MergeChannels merges any number of already-sorted, channel-backed line
+// streams into one sorted output channel, according to cfg.  It is the
+// channel-based counterpart of mergeSimple, letting callers compose sorted
+// streams (e.g. from network shards) without going through the filesystem.
+// The returned channel is closed once every input channel is closed and
+// drained, or once ctx is done.  If the consumer stops reading out before
+// it is drained, cancel ctx so the producing goroutine can stop instead of
+// blocking on out forever.
+func MergeChannels(ctx context.Context, cfg Config, ins ...<-chan string) <-chan string {
+	out := make(chan string)
+
+	go func() {
+		defer close(out)
+
+		nodes := make([]lineSource, 0, len(ins))
+		for _, in := range ins {
+			cs, err := newChanSource(in)
+			if err == io.EOF {
+				continue
+			}
+			nodes = append(nodes, cs)
+		}
+
+		sources := newSourceSetFrom(nodes, cfg)
+		for {
+			line, ok, err := sources.popMin()
+			if err != nil || !ok {
+				return
+			}
+			select {
+			case out <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
 func main() {
 	var limit int
 	var help bool
+	var reverse, unique, numeric bool
+	var key int
+	var delim string
+	var byteLimitStr string
+	var workers int
 
 	flag.IntVar(&limit, "limit", 10000,
 		"maximum number of lines per initial chunk")
+	flag.StringVar(&byteLimitStr, "bytes", "",
+		"maximum approximate size per initial chunk (e.g. 256K, 256M, 1G); "+
+			"combined with -limit, whichever is reached first ends the chunk")
+	flag.BoolVar(&reverse, "r", false, "sort in reverse order")
+	flag.BoolVar(&unique, "u", false, "output only the first of equal lines")
+	flag.BoolVar(&numeric, "n", false, "compare according to numeric value")
+	flag.IntVar(&key, "k", 0,
+		"sort by field number KEY (1-based) instead of the whole line")
+	flag.StringVar(&delim, "t", "",
+		"field delimiter for -k (default: runs of whitespace)")
+	flag.IntVar(&workers, "workers", 0,
+		"number of chunks to sort and flush to disk concurrently (default: GOMAXPROCS)")
 	flag.BoolVar(&help, "help", false, "displays this help message")
 
 	flag.Parse()
@@ -387,11 +1031,24 @@ func main() {
 
 	if (flag.NArg() > 2) || help {
 		fmt.Fprintln(os.Stderr,
-			"Usage: filesort [-limit LIMIT] [INFILE [OUTFILE]]")
+			"Usage: filesort [-limit LIMIT] [-bytes SIZE] [-r] [-u] [-n] [-k KEY] [-t DELIM] [-workers N] [INFILE [OUTFILE]]")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	byteLimit, err := parseByteSize(byteLimitStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg := Config{
+		Less:      BuildLess(reverse, numeric, key, delim),
+		Unique:    unique,
+		ByteLimit: byteLimit,
+		Workers:   workers,
+	}
+
 	var in io.Reader
 
 	if flag.NArg() == 0 {
@@ -408,12 +1065,10 @@ func main() {
 		in = f
 	}
 
-	var err error
-
 	if flag.NArg() == 2 {
-		err = sortLinesFile(in, limit, flag.Arg(1))
+		err = sortLinesFile(in, limit, flag.Arg(1), cfg)
 	} else {
-		err = sortLinesWrite(in, limit, os.Stdout)
+		err = sortLinesWrite(in, limit, os.Stdout, cfg)
 	}
 
 	if err != nil {
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// sortString runs sortLinesWrite over input with the given limit and cfg,
+// against a MemFS, and returns the sorted output.
+func sortString(t *testing.T, input string, limit int, cfg Config) string {
+	t.Helper()
+
+	cfg.FS = NewMemFS()
+	var out bytes.Buffer
+	if err := sortLinesWrite(strings.NewReader(input), limit, &out, cfg); err != nil {
+		t.Fatalf("sortLinesWrite: %v", err)
+	}
+	return out.String()
+}
+
+func TestSortLinesWriteRoundTrip(t *testing.T) {
+	input := "banana\napple\ncherry\ndate\nfig\napple\n"
+	want := "apple\napple\nbanana\ncherry\ndate\nfig\n"
+
+	// Limit of 2 forces several chunks to spill and be merged back together.
+	got := sortString(t, input, 2, DefaultConfig())
+	if got != want {
+		t.Errorf("sortLinesWrite(limit=2) = %q, want %q", got, want)
+	}
+}
+
+func TestSortLinesWriteEmptyInput(t *testing.T) {
+	got := sortString(t, "", 2, DefaultConfig())
+	if got != "" {
+		t.Errorf("sortLinesWrite(empty) = %q, want empty", got)
+	}
+}
+
+func TestSortLinesWriteUnique(t *testing.T) {
+	input := "b\na\nb\na\nc\n"
+	want := "a\nb\nc\n"
+
+	cfg := DefaultConfig()
+	cfg.Unique = true
+	got := sortString(t, input, 2, cfg)
+	if got != want {
+		t.Errorf("sortLinesWrite(unique) = %q, want %q", got, want)
+	}
+}
+
+func TestBuildLess(t *testing.T) {
+	cases := []struct {
+		name             string
+		reverse, numeric bool
+		key              int
+		delim            string
+		input, want      string
+	}{
+		{
+			name:    "reverse",
+			reverse: true,
+			input:   "a\nb\nc\n",
+			want:    "c\nb\na\n",
+		},
+		{
+			name:    "numeric",
+			numeric: true,
+			input:   "10\n2\n1\n",
+			want:    "1\n2\n10\n",
+		},
+		{
+			name:  "key column",
+			key:   2,
+			delim: ",",
+			input: "1,z\n2,a\n3,m\n",
+			want:  "2,a\n3,m\n1,z\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Config{Less: BuildLess(c.reverse, c.numeric, c.key, c.delim)}
+			got := sortString(t, c.input, 100, cfg)
+			if got != c.want {
+				t.Errorf("%v: sortLinesWrite = %q, want %q", c.name, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSourceSetHeapOrdering(t *testing.T) {
+	rs := []io.Reader{
+		strings.NewReader("c\nf\ni\n"),
+		strings.NewReader("a\nd\ng\n"),
+		strings.NewReader("b\ne\nh\n"),
+	}
+
+	ss, err := newSourceSet(rs, DefaultConfig())
+	if err != nil {
+		t.Fatalf("newSourceSet: %v", err)
+	}
+
+	var got []string
+	for {
+		line, ok, err := ss.popMin()
+		if err != nil {
+			t.Fatalf("popMin: %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, strings.TrimSuffix(line, "\n"))
+	}
+
+	want := "a,b,c,d,e,f,g,h,i"
+	if strings.Join(got, ",") != want {
+		t.Errorf("popMin order = %v, want %v", got, want)
+	}
+}
+
+func TestSortChannel(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FS = NewMemFS()
+
+	in := make(chan string)
+	go func() {
+		defer close(in)
+		for _, line := range []string{"banana\n", "apple\n", "cherry\n", "date\n"} {
+			in <- line
+		}
+	}()
+
+	// Limit of 2 forces chunks to spill to disk and be merged back together.
+	out := SortChannel(context.Background(), in, 2, cfg)
+
+	var got []string
+	for line := range out {
+		got = append(got, strings.TrimSuffix(line, "\n"))
+	}
+
+	want := "apple,banana,cherry,date"
+	if strings.Join(got, ",") != want {
+		t.Errorf("SortChannel order = %v, want %v", got, want)
+	}
+}
+
+func TestSortChannelCancel(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FS = NewMemFS()
+
+	in := make(chan string)
+	go func() {
+		defer close(in)
+		for _, line := range []string{"b\n", "a\n", "d\n", "c\n"} {
+			in <- line
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Limit of 1 forces a disk-backed merge; reading only the first line and
+	// then cancelling must not leave the producing goroutine parked forever
+	// on an unread out channel.
+	out := SortChannel(ctx, in, 1, cfg)
+	<-out
+	cancel()
+	for range out {
+	}
+}
+
+func TestMergeChannels(t *testing.T) {
+	cfg := DefaultConfig()
+
+	a := make(chan string)
+	b := make(chan string)
+	go func() {
+		defer close(a)
+		a <- "apple\n"
+		a <- "cherry\n"
+	}()
+	go func() {
+		defer close(b)
+		b <- "banana\n"
+		b <- "date\n"
+	}()
+
+	out := MergeChannels(context.Background(), cfg, a, b)
+
+	var got []string
+	for line := range out {
+		got = append(got, strings.TrimSuffix(line, "\n"))
+	}
+
+	want := "apple,banana,cherry,date"
+	if strings.Join(got, ",") != want {
+		t.Errorf("MergeChannels order = %v, want %v", got, want)
+	}
+}
+
+func TestSplitByteLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FS = NewMemFS()
+	cfg.ByteLimit = 4
+
+	// Each line is 2 bytes, so a 4-byte budget should end a chunk after 2
+	// lines even though the line-count limit alone would not.
+	input := "a\nb\nc\nd\n"
+	names, err := split(strings.NewReader(input), 100, cfg)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+
+	if len(names) <= 1 {
+		t.Errorf("split with ByteLimit=4 produced %d chunk(s), want more than 1", len(names))
+	}
+}